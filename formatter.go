@@ -0,0 +1,121 @@
+package logrus_mail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/Philoinc/logrus"
+)
+
+// Formatter renders a log entry into an email subject and body, mirroring
+// logrus's own Formatter interface. trace is the assembled stack trace for
+// the event, already formatted as human-readable text.
+type Formatter interface {
+	// Subject returns the subject line for entry.
+	Subject(entry *logrus.Entry, appname string) string
+	// Format renders entry and trace into a message body.
+	Format(entry *logrus.Entry, appname string, trace string) ([]byte, error)
+}
+
+// htmlBodied is implemented by Formatters whose Format output is already a
+// complete HTML document, letting createMessage skip generating a
+// redundant text/html alternative part.
+type htmlBodied interface {
+	isHTML()
+}
+
+// sortedFields returns entry.Data's keys in a stable order, so repeated
+// renders of the same entry produce byte-identical output.
+func sortedFields(entry *logrus.Entry) []string {
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TextFormatter renders the body as logfmt-style "key=value" pairs, one
+// line for time, level and message and one per field, followed by the
+// stack trace. It is the default Formatter.
+type TextFormatter struct{}
+
+func (f *TextFormatter) Subject(entry *logrus.Entry, appname string) string {
+	return appname + " - " + entry.Level.String()
+}
+
+func (f *TextFormatter) Format(entry *logrus.Entry, appname string, trace string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time=%q level=%s msg=%q\r\n", entry.Time.Format(format), entry.Level.String(), entry.Message)
+	for _, k := range sortedFields(entry) {
+		fmt.Fprintf(&buf, "%s=%q\r\n", k, fmt.Sprintf("%v", entry.Data[k]))
+	}
+	if trace != "" {
+		buf.WriteString("\r\n")
+		buf.WriteString(trace)
+	}
+	return buf.Bytes(), nil
+}
+
+// JSONFormatter renders the body as a single JSON document containing the
+// entry's time, level, message, fields, and stack trace.
+type JSONFormatter struct{}
+
+func (f *JSONFormatter) Subject(entry *logrus.Entry, appname string) string {
+	return appname + " - " + entry.Level.String()
+}
+
+func (f *JSONFormatter) Format(entry *logrus.Entry, appname string, trace string) ([]byte, error) {
+	doc := map[string]interface{}{
+		"time":  entry.Time.Format(format),
+		"level": entry.Level.String(),
+		"msg":   entry.Message,
+		"data":  entry.Data,
+	}
+	if trace != "" {
+		doc["trace"] = strings.Split(strings.TrimRight(trace, "\r\n"), "\r\n")
+	}
+	return json.MarshalIndent(doc, "", "\t")
+}
+
+// HTMLFormatter renders the body as an HTML document, laying fields out as
+// a table and the stack trace in a <pre> block. createMessage also uses it
+// internally to build the text/html alternative for other Formatters.
+type HTMLFormatter struct{}
+
+func (f *HTMLFormatter) isHTML() {}
+
+func (f *HTMLFormatter) Subject(entry *logrus.Entry, appname string) string {
+	return appname + " - " + entry.Level.String()
+}
+
+func (f *HTMLFormatter) Format(entry *logrus.Entry, appname string, trace string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<html><body>\r\n")
+	fmt.Fprintf(&buf, "<p><strong>%s</strong> &mdash; %s</p>\r\n",
+		html.EscapeString(entry.Level.String()), html.EscapeString(entry.Time.Format(format)))
+	fmt.Fprintf(&buf, "<p>%s</p>\r\n", html.EscapeString(entry.Message))
+
+	if len(entry.Data) > 0 {
+		buf.WriteString("<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\">\r\n")
+		buf.WriteString("<tr><th align=\"left\">Field</th><th align=\"left\">Value</th></tr>\r\n")
+		for _, k := range sortedFields(entry) {
+			fmt.Fprintf(&buf, "<tr><td>%s</td><td>%s</td></tr>\r\n",
+				html.EscapeString(k), html.EscapeString(fmt.Sprintf("%v", entry.Data[k])))
+		}
+		buf.WriteString("</table>\r\n")
+	}
+
+	if trace != "" {
+		buf.WriteString("<pre>")
+		buf.WriteString(html.EscapeString(trace))
+		buf.WriteString("</pre>\r\n")
+	}
+
+	buf.WriteString("</body></html>\r\n")
+	return buf.Bytes(), nil
+}
@@ -2,27 +2,85 @@ package logrus_mail
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"mime/multipart"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"runtime"
 
 	"github.com/Philoinc/logrus"
 )
 
 const (
 	format = "20060102 15:04:05"
-	MAX_DEPTH = 100
+	// MaxFrames is the default cap on stack frames kept in a trace when a
+	// hook's MaxFrames field is unset.
+	MaxFrames = 100
 )
 
 // MailHook to sends logs by email without authentication.
 type MailHook struct {
 	AppName string
-	c       *smtp.Client
+	Host    string
+	Port    int
+	From    *mail.Address
+	To      *mail.Address
+
+	// TLSMode selects how the connection to the server is secured.
+	// Defaults to TLSNone, matching the hook's historical behavior.
+	TLSMode TLSMode
+	// TLSConfig configures the TLS handshake performed for TLSStartTLS and
+	// TLSImplicit. ServerName defaults to the hook's host when unset.
+	TLSConfig *tls.Config
+	// TLSRequired causes TLSStartTLS to fail instead of silently falling
+	// back to plaintext when the server doesn't advertise STARTTLS.
+	TLSRequired bool
+
+	// Formatter renders the email subject and body. Defaults to
+	// &TextFormatter{} when nil.
+	Formatter Formatter
+
+	// RateLimit caps how many mails are sent per minute. Nil disables the
+	// limit.
+	RateLimit *RateLimit
+	// Dedup suppresses repeated identical entries within a time window.
+	// Nil disables deduplication.
+	Dedup *Dedup
+	// BatchInterval, when non-zero, coalesces entries arriving within the
+	// interval into a single digest email instead of one per entry.
+	BatchInterval time.Duration
+	// OverflowPolicy controls entries that arrive once RateLimit's bucket
+	// is exhausted. Defaults to Drop.
+	OverflowPolicy OverflowPolicy
+
+	// MaxFrames caps how many stack frames are kept in a trace. Defaults
+	// to MaxFrames (the package constant) when zero.
+	MaxFrames int
+	// TraceSkipPattern additionally filters frames out of the trace,
+	// beyond the package's own internal logrus_mail/logrus/runtime frames
+	// -- useful for trimming a caller's own middleware.
+	TraceSkipPattern []*regexp.Regexp
+
+	// Workers sets the delivery worker-pool size. Defaults to 4.
+	Workers int
+	// QueueSize bounds how many pending mails may be queued for delivery
+	// before new ones are dropped. Defaults to 64.
+	QueueSize int
+
+	fc     floodControlState
+	dw     *deliveryWorker
+	dwOnce sync.Once
 }
 
 // MailAuthHook to sends logs by email with authentication.
@@ -34,15 +92,79 @@ type MailAuthHook struct {
 	To       *mail.Address
 	Username string
 	Password string
+
+	// Auth overrides mechanism selection entirely with a caller-supplied
+	// smtp.Auth. When nil, AuthMethod (and the server's advertised AUTH
+	// mechanisms, for AuthAuto) decide.
+	Auth smtp.Auth
+	// AuthMethod selects the SMTP AUTH mechanism to use when Auth is nil.
+	// Defaults to AuthPlain.
+	AuthMethod AuthMethod
+
+	// TLSMode selects how the connection to the server is secured.
+	// Defaults to TLSNone, matching the hook's historical behavior.
+	TLSMode TLSMode
+	// TLSConfig configures the TLS handshake performed for TLSStartTLS and
+	// TLSImplicit. ServerName defaults to Host when unset.
+	TLSConfig *tls.Config
+	// TLSRequired causes TLSStartTLS to fail instead of silently falling
+	// back to plaintext when the server doesn't advertise STARTTLS.
+	TLSRequired bool
+
+	// Formatter renders the email subject and body. Defaults to
+	// &TextFormatter{} when nil.
+	Formatter Formatter
+
+	// RateLimit caps how many mails are sent per minute. Nil disables the
+	// limit.
+	RateLimit *RateLimit
+	// Dedup suppresses repeated identical entries within a time window.
+	// Nil disables deduplication.
+	Dedup *Dedup
+	// BatchInterval, when non-zero, coalesces entries arriving within the
+	// interval into a single digest email instead of one per entry.
+	BatchInterval time.Duration
+	// OverflowPolicy controls entries that arrive once RateLimit's bucket
+	// is exhausted. Defaults to Drop.
+	OverflowPolicy OverflowPolicy
+
+	// MaxFrames caps how many stack frames are kept in a trace. Defaults
+	// to MaxFrames (the package constant) when zero.
+	MaxFrames int
+	// TraceSkipPattern additionally filters frames out of the trace,
+	// beyond the package's own internal logrus_mail/logrus/runtime frames
+	// -- useful for trimming a caller's own middleware.
+	TraceSkipPattern []*regexp.Regexp
+
+	// Workers sets the delivery worker-pool size. Defaults to 4.
+	Workers int
+	// QueueSize bounds how many pending mails may be queued for delivery
+	// before new ones are dropped. Defaults to 64.
+	QueueSize int
+
+	fc     floodControlState
+	dw     *deliveryWorker
+	dwOnce sync.Once
 }
 
 // NewMailHook creates a hook to be added to an instance of logger.
 func NewMailHook(appname string, host string, port int, from string, to string) (*MailHook, error) {
-	// Connect to the remote SMTP server.
-	c, err := smtp.Dial(host + ":" + strconv.Itoa(port))
+	return NewMailHookWithTLS(appname, host, port, from, to, TLSNone, nil)
+}
+
+// NewMailHookWithTLS creates a hook to be added to an instance of logger,
+// securing the connection to host according to tlsMode. tlsConfig may be
+// nil to accept the package defaults (ServerName set to host).
+func NewMailHookWithTLS(appname string, host string, port int, from string, to string, tlsMode TLSMode, tlsConfig *tls.Config) (*MailHook, error) {
+	// Connect to the remote SMTP server just to validate that it's
+	// reachable and will accept the sender/recipient -- deliver redials
+	// and replays MAIL/RCPT/DATA for every message, since a single
+	// *smtp.Client can only ever carry one such transaction.
+	c, err := dialSMTP(host, host+":"+strconv.Itoa(port), tlsMode, tlsConfig, false)
 	if err != nil {
 		return nil, err
 	}
+	defer c.Close()
 
 	// Validate sender and recipient
 	sender, err := mail.ParseAddress(from)
@@ -63,8 +185,13 @@ func NewMailHook(appname string, host string, port int, from string, to string)
 	}
 
 	return &MailHook{
-		AppName: appname,
-		c:       c,
+		AppName:   appname,
+		Host:      host,
+		Port:      port,
+		From:      sender,
+		To:        recipient,
+		TLSMode:   tlsMode,
+		TLSConfig: tlsConfig,
 	}, nil
 
 }
@@ -98,42 +225,285 @@ func NewMailAuthHook(appname string, host string, port int, from string, to stri
 		Password: password}, nil
 }
 
+// NewMailAuthHookWithTLS creates a hook to be added to an instance of
+// logger, securing the connection to host according to tlsMode and
+// authenticating with AuthPlain. tlsConfig may be nil to accept the
+// package defaults (ServerName set to host).
+func NewMailAuthHookWithTLS(appname string, host string, port int, from string, to string, username string, password string, tlsMode TLSMode, tlsConfig *tls.Config) (*MailAuthHook, error) {
+	return NewMailAuthHookWithAuth(appname, host, port, from, to, username, password, AuthPlain, tlsMode, tlsConfig)
+}
+
+// NewMailAuthHookWithAuth creates a hook to be added to an instance of
+// logger, securing the connection according to tlsMode and validating, at
+// construction time, that authMethod (or, for AuthAuto, whatever mechanism
+// the server's EHLO AUTH line selects) actually authenticates -- the way
+// NewMailHookWithTLS validates its MAIL/RCPT transaction up front.
+// tlsConfig may be nil to accept the package defaults (ServerName set to
+// host).
+func NewMailAuthHookWithAuth(appname string, host string, port int, from string, to string, username string, password string, authMethod AuthMethod, tlsMode TLSMode, tlsConfig *tls.Config) (*MailAuthHook, error) {
+	c, err := dialSMTP(host, host+":"+strconv.Itoa(port), tlsMode, tlsConfig, false)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Validate sender and recipient
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var authLine string
+	if ok, line := c.Extension("AUTH"); ok {
+		authLine = line
+	}
+	auth, err := selectAuth(authMethod, authLine, username, password, host)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Auth(auth); err != nil {
+		return nil, err
+	}
+
+	if err := c.Mail(sender.Address); err != nil {
+		return nil, err
+	}
+	if err := c.Rcpt(recipient.Address); err != nil {
+		return nil, err
+	}
+
+	return &MailAuthHook{
+		AppName:    appname,
+		Host:       host,
+		Port:       port,
+		From:       sender,
+		To:         recipient,
+		Username:   username,
+		Password:   password,
+		AuthMethod: authMethod,
+		TLSMode:    tlsMode,
+		TLSConfig:  tlsConfig,
+	}, nil
+}
+
+// floodConfig gathers hook's rate-limiting, dedup and batching settings for
+// floodControlState.
+func (hook *MailHook) floodConfig() floodConfig {
+	return floodConfig{
+		RateLimit:      hook.RateLimit,
+		Dedup:          hook.Dedup,
+		BatchInterval:  hook.BatchInterval,
+		OverflowPolicy: hook.OverflowPolicy,
+	}
+}
+
+// worker lazily starts the hook's delivery worker pool.
+func (hook *MailHook) worker() *deliveryWorker {
+	hook.dwOnce.Do(func() {
+		workers, queueSize := hook.Workers, hook.QueueSize
+		if workers <= 0 {
+			workers = 4
+		}
+		if queueSize <= 0 {
+			queueSize = 64
+		}
+		hook.dw = newDeliveryWorker(workers, queueSize)
+	})
+	return hook.dw
+}
+
 // Fire is called when a log event is fired.
 func (hook *MailHook) Fire(entry *logrus.Entry) error {
-	wc, err := hook.c.Data()
+	item := traced{
+		entry:       entry,
+		trace:       buildTrace(hook.MaxFrames, hook.TraceSkipPattern),
+		goroutineID: currentGoroutineID(),
+	}
+	var fireErr error
+	hook.fc.Fire(item, hook.floodConfig(), func(items []traced) {
+		digestEntry, trace, goroutineID := digest(items)
+		message, err := createMessage(digestEntry, hook.AppName, "", "", trace, goroutineID, hook.Formatter)
+		if err != nil {
+			fireErr = err
+			return
+		}
+		if !hook.worker().Submit(func() error { return hook.deliver(message) }) {
+			fireErr = errors.New("logrus_mail: delivery queue full, message dropped")
+		}
+	})
+	return fireErr
+}
+
+// deliver connects to the server and delivers message over its own
+// MAIL/RCPT/DATA transaction, the way MailAuthHook.send does -- one
+// *smtp.Client transaction can't be replayed for a second message.
+func (hook *MailHook) deliver(message *bytes.Buffer) error {
+	addr := hook.Host + ":" + strconv.Itoa(hook.Port)
+	c, err := dialSMTP(hook.Host, addr, hook.TLSMode, hook.TLSConfig, hook.TLSRequired)
 	if err != nil {
 		return err
 	}
-	defer wc.Close()
-	message := createMessage(entry, hook.AppName, "", "")
-	if _, err = message.WriteTo(wc); err != nil {
+	defer c.Close()
+
+	if err := c.Mail(hook.From.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(hook.To.Address); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
 		return err
 	}
-	return nil
+	if _, err := message.WriteTo(wc); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Close stops accepting new mail, flushes any entry still held back by
+// Dedup or BatchInterval out for delivery, and waits for whatever is
+// queued to finish sending, or for ctx to be done, whichever comes first.
+func (hook *MailHook) Close(ctx context.Context) error {
+	hook.fc.Flush(func(items []traced) {
+		digestEntry, trace, goroutineID := digest(items)
+		message, err := createMessage(digestEntry, hook.AppName, "", "", trace, goroutineID, hook.Formatter)
+		if err != nil {
+			return
+		}
+		hook.worker().Submit(func() error { return hook.deliver(message) })
+	})
+
+	if hook.dw == nil {
+		return nil
+	}
+	return hook.dw.Close(ctx)
+}
+
+// floodConfig gathers hook's rate-limiting, dedup and batching settings for
+// floodControlState.
+func (hook *MailAuthHook) floodConfig() floodConfig {
+	return floodConfig{
+		RateLimit:      hook.RateLimit,
+		Dedup:          hook.Dedup,
+		BatchInterval:  hook.BatchInterval,
+		OverflowPolicy: hook.OverflowPolicy,
+	}
+}
+
+// worker lazily starts the hook's delivery worker pool.
+func (hook *MailAuthHook) worker() *deliveryWorker {
+	hook.dwOnce.Do(func() {
+		workers, queueSize := hook.Workers, hook.QueueSize
+		if workers <= 0 {
+			workers = 4
+		}
+		if queueSize <= 0 {
+			queueSize = 64
+		}
+		hook.dw = newDeliveryWorker(workers, queueSize)
+	})
+	return hook.dw
 }
 
 // Fire is called when a log event is fired.
 func (hook *MailAuthHook) Fire(entry *logrus.Entry) error {
-	message := createMessage(entry, hook.AppName, hook.From.Address, hook.To.Address)
-
-	// Spawn the actual email sending since it appears to interfere with
-	// the HTTP request handling when a panic is caught and handled
-	// NOTE: It is critical that the message, which includes the stack
-	//       trace details, is created before the go routine is called
-	go func() {
-		// Connect to the server, authenticate, set the sender and recipient,
-		// and send the email all in one step.
-		auth := smtp.PlainAuth("", hook.Username, hook.Password, hook.Host)
-		smtp.SendMail(
-			hook.Host+":"+strconv.Itoa(hook.Port),
-			auth,
-			hook.From.Address,
-			[]string{hook.To.Address},
-			message.Bytes(),
-		)
-	}()
-
-	return nil
+	item := traced{
+		entry:       entry,
+		trace:       buildTrace(hook.MaxFrames, hook.TraceSkipPattern),
+		goroutineID: currentGoroutineID(),
+	}
+	var fireErr error
+	hook.fc.Fire(item, hook.floodConfig(), func(items []traced) {
+		digestEntry, trace, goroutineID := digest(items)
+		message, err := createMessage(digestEntry, hook.AppName, hook.From.Address, hook.To.Address, trace, goroutineID, hook.Formatter)
+		if err != nil {
+			fireErr = err
+			return
+		}
+
+		// Hand delivery to the worker pool instead of sending here, since
+		// SMTP I/O appears to interfere with the HTTP request handling
+		// when a panic is caught and handled.
+		// NOTE: It is critical that the message, which includes the stack
+		//       trace details, is created before the entry is submitted.
+		if !hook.worker().Submit(func() error { return hook.send(message) }) {
+			fireErr = errors.New("logrus_mail: delivery queue full, message dropped")
+		}
+	})
+
+	return fireErr
+}
+
+// Close stops accepting new mail, flushes any entry still held back by
+// Dedup or BatchInterval out for delivery, and waits for whatever is
+// queued to finish sending, or for ctx to be done, whichever comes first.
+func (hook *MailAuthHook) Close(ctx context.Context) error {
+	hook.fc.Flush(func(items []traced) {
+		digestEntry, trace, goroutineID := digest(items)
+		message, err := createMessage(digestEntry, hook.AppName, hook.From.Address, hook.To.Address, trace, goroutineID, hook.Formatter)
+		if err != nil {
+			return
+		}
+		hook.worker().Submit(func() error { return hook.send(message) })
+	})
+
+	if hook.dw == nil {
+		return nil
+	}
+	return hook.dw.Close(ctx)
+}
+
+// send connects to the server, authenticates, and delivers message.
+func (hook *MailAuthHook) send(message *bytes.Buffer) error {
+	addr := hook.Host + ":" + strconv.Itoa(hook.Port)
+	c, err := dialSMTP(hook.Host, addr, hook.TLSMode, hook.TLSConfig, hook.TLSRequired)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	auth := hook.Auth
+	if auth == nil {
+		var authLine string
+		if ok, line := c.Extension("AUTH"); ok {
+			authLine = line
+		}
+		auth, err = selectAuth(hook.AuthMethod, authLine, hook.Username, hook.Password, hook.Host)
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.Auth(auth); err != nil {
+		return err
+	}
+
+	if err := c.Mail(hook.From.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(hook.To.Address); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := message.WriteTo(wc); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
 }
 
 // Levels returns the available logging levels.
@@ -154,38 +524,104 @@ func (hook *MailHook) Levels() []logrus.Level {
 	}
 }
 
-func createMessage(entry *logrus.Entry, appname string, from string, to string) *bytes.Buffer {
-	// Cobble together a stack trace as best we can
-	trace   := ""
-	callers := make([]uintptr, MAX_DEPTH+1)
-	depth   := runtime.Callers(1, callers)
-	for i := 0; i < depth; i++ {
-		pc := callers[i]
-		function := runtime.FuncForPC(pc)
-		if function == nil {
-			break
+// newMessageID generates an RFC 5322 Message-ID, qualified with host (the
+// envelope sender's domain when known, else the local hostname).
+func newMessageID(host string) string {
+	if host == "" {
+		if h, err := os.Hostname(); err == nil {
+			host = h
+		} else {
+			host = "localhost"
+		}
+	}
+	return fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), host)
+}
+
+// writeHeader writes header's well-known fields, in RFC 5322-ish order,
+// followed by the blank line that separates headers from body.
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, k := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "X-Goroutine-Id", "X-Goroutine-Count", "Content-Type"} {
+		if v := header.Get(k); v != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
 		}
-		name := function.Name()
-		entry := function.Entry()
-		file, line := function.FileLine(pc)
-		trace += fmt.Sprintf("Frame %02d:\r\n", i)
-		trace += fmt.Sprintf("\tFile: %s\r\n", file)
-		trace += fmt.Sprintf("\tFunction: %s\r\n", name)
-		trace += fmt.Sprintf("\tLine: %d\r\n", line)
-		trace += fmt.Sprintf("\tPC/Entry: 0x%08x/0x%08x\r\n", pc, entry)
-	}
-	subject := appname + " - " + entry.Level.String()
-	fields, _ := json.MarshalIndent(entry.Data, "", "\t")
-	body := entry.Time.Format(format) + " - " + entry.Message + "\r\n\r\n"
-	body += trace + "\r\n\r\nData:\r\n\r\n" + fmt.Sprintf("%s", fields)
-	contents:= ""
+	}
+	buf.WriteString("\r\n")
+}
+
+// createMessage renders entry and its already-captured trace into a MIME
+// message using formatter (or &TextFormatter{} if nil), pairing it with a
+// generated text/html alternative unless formatter already produces one
+// itself. goroutineID, along with the current runtime.NumGoroutine(), is
+// surfaced as diagnostic X-Goroutine-* headers.
+func createMessage(entry *logrus.Entry, appname string, from string, to string, trace string, goroutineID int, formatter Formatter) (*bytes.Buffer, error) {
+	if formatter == nil {
+		formatter = &TextFormatter{}
+	}
+
+	body, err := formatter.Format(entry, appname, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(textproto.MIMEHeader)
 	if from != "" {
-		contents += fmt.Sprintf("From: %s\r\n", from)
+		header.Set("From", from)
 	}
 	if to != "" {
-		contents += fmt.Sprintf("To: %s\r\n", to)
+		header.Set("To", to)
+	}
+	header.Set("Subject", formatter.Subject(entry, appname))
+	header.Set("Date", entry.Time.Format(time.RFC1123Z))
+	senderDomain := ""
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		senderDomain = from[i+1:]
 	}
-	contents += fmt.Sprintf("Subject: %s\r\n\r\n%s\r\n\r\n", subject, body)
-	message := bytes.NewBufferString(contents)
-	return message
+	header.Set("Message-ID", newMessageID(senderDomain))
+	header.Set("MIME-Version", "1.0")
+	header.Set("X-Goroutine-Id", strconv.Itoa(goroutineID))
+	header.Set("X-Goroutine-Count", strconv.Itoa(runtime.NumGoroutine()))
+
+	message := &bytes.Buffer{}
+
+	if _, ok := formatter.(htmlBodied); ok {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		writeHeader(message, header)
+		message.Write(body)
+		return message, nil
+	}
+
+	htmlBody, err := (&HTMLFormatter{}).Format(entry, appname, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts bytes.Buffer
+	mw := multipart.NewWriter(&parts)
+
+	plainHeader := textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}}
+	pw, err := mw.CreatePart(plainHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pw.Write(body); err != nil {
+		return nil, err
+	}
+
+	htmlHeader := textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}}
+	hw, err := mw.CreatePart(htmlHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := hw.Write(htmlBody); err != nil {
+		return nil, err
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", mw.Boundary()))
+	writeHeader(message, header)
+	message.Write(parts.Bytes())
+	return message, nil
 }
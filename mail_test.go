@@ -0,0 +1,221 @@
+package logrus_mail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Philoinc/logrus"
+)
+
+// fakeSMTPServer is a minimal SMTP server that enforces the real protocol
+// rule: DATA must be preceded by a MAIL+RCPT in the *current* transaction.
+// It records whether any client violated that rule.
+type fakeSMTPServer struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	dataCount int
+	violation bool
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln}
+	go s.run()
+	return s
+}
+
+func (s *fakeSMTPServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTPServer) hostPort() (string, int) {
+	addr := s.addr()
+	idx := strings.LastIndex(addr, ":")
+	port, _ := strconv.Atoi(addr[idx+1:])
+	return addr[:idx], port
+}
+
+func (s *fakeSMTPServer) run() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := conn
+	fmt.Fprintf(w, "220 fake.local ESMTP\r\n")
+
+	haveMailRcpt := false
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		upper := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(upper, "EHLO"), strings.HasPrefix(upper, "HELO"):
+			fmt.Fprintf(w, "250-fake.local\r\n250 OK\r\n")
+		case strings.HasPrefix(upper, "MAIL FROM"):
+			haveMailRcpt = false
+			fmt.Fprintf(w, "250 OK\r\n")
+		case strings.HasPrefix(upper, "RCPT TO"):
+			haveMailRcpt = true
+			fmt.Fprintf(w, "250 OK\r\n")
+		case strings.HasPrefix(upper, "DATA"):
+			s.mu.Lock()
+			s.dataCount++
+			if !haveMailRcpt {
+				s.violation = true
+			}
+			s.mu.Unlock()
+			if !haveMailRcpt {
+				fmt.Fprintf(w, "503 bad sequence of commands\r\n")
+				continue
+			}
+			fmt.Fprintf(w, "354 go ahead\r\n")
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimRight(l, "\r\n") == "." {
+					break
+				}
+			}
+			fmt.Fprintf(w, "250 OK queued\r\n")
+			haveMailRcpt = false // transaction consumed; need a fresh MAIL/RCPT for the next message
+		case strings.HasPrefix(upper, "QUIT"):
+			fmt.Fprintf(w, "221 bye\r\n")
+			return
+		case strings.HasPrefix(upper, "RSET"):
+			haveMailRcpt = false
+			fmt.Fprintf(w, "250 OK\r\n")
+		default:
+			fmt.Fprintf(w, "250 OK\r\n")
+		}
+	}
+}
+
+// TestMailHookRedialsPerMessage guards against MailHook replaying a second
+// message over the single *smtp.Client transaction opened at construction
+// time -- a server enforcing the real SMTP sequencing rejects the second
+// DATA outright, and Fire swallowed the failure as a silent drop.
+func TestMailHookRedialsPerMessage(t *testing.T) {
+	srv := startFakeSMTP(t)
+	defer srv.ln.Close()
+	host, port := srv.hostPort()
+
+	hook, err := NewMailHook("app", host, port, "from@example.com", "to@example.com")
+	if err != nil {
+		t.Fatalf("NewMailHook: %v", err)
+	}
+
+	if err := hook.Fire(&logrus.Entry{Message: "first", Level: logrus.ErrorLevel, Data: logrus.Fields{}}); err != nil {
+		t.Fatalf("first Fire: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := hook.Fire(&logrus.Entry{Message: "second", Level: logrus.ErrorLevel, Data: logrus.Fields{}}); err != nil {
+		t.Fatalf("second Fire: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.violation {
+		t.Fatalf("second DATA was not preceded by its own MAIL/RCPT -- deliver reused a stale transaction")
+	}
+	if got := hook.worker().Sent(); got != 2 {
+		t.Fatalf("expected both messages sent, got sent=%d dropped=%d", got, hook.worker().Dropped())
+	}
+}
+
+// TestCloseFlushesPendingBatch guards against Close returning while an
+// entry is still sitting in BatchInterval's coalescing window: it should
+// force that batch out for delivery and wait for it to send, not abandon
+// it to a timer goroutine the caller can no longer observe.
+func TestCloseFlushesPendingBatch(t *testing.T) {
+	srv := startFakeSMTP(t)
+	defer srv.ln.Close()
+	host, port := srv.hostPort()
+
+	hook, err := NewMailHook("app", host, port, "from@example.com", "to@example.com")
+	if err != nil {
+		t.Fatalf("NewMailHook: %v", err)
+	}
+	hook.BatchInterval = 2 * time.Second
+
+	if err := hook.Fire(&logrus.Entry{Message: "batched", Level: logrus.ErrorLevel, Data: logrus.Fields{}}); err != nil {
+		t.Fatalf("Fire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hook.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if hook.dw == nil {
+		t.Fatalf("Close returned while hook.dw is still nil -- the batched entry was never even submitted for delivery, let alone flushed")
+	}
+	if got := hook.worker().Sent(); got != 1 {
+		t.Fatalf("expected 1 message sent by the time Close returns, got sent=%d dropped=%d", got, hook.worker().Dropped())
+	}
+}
+
+// TestMailAuthHookFireReturnsQueueFullError guards against MailAuthHook.Fire
+// always returning nil: it should surface a dropped-message error the same
+// way MailHook.Fire does, so callers get consistent error visibility from
+// both hooks.
+func TestMailAuthHookFireReturnsQueueFullError(t *testing.T) {
+	from, _ := mail.ParseAddress("from@example.com")
+	to, _ := mail.ParseAddress("to@example.com")
+	hook := &MailAuthHook{
+		AppName:   "app",
+		Host:      "127.0.0.1",
+		Port:      1,
+		From:      from,
+		To:        to,
+		Workers:   1,
+		QueueSize: 1,
+	}
+
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+
+	hook.worker().Submit(func() error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started // the sole worker is now occupied, freeing the queue's one slot
+
+	if !hook.worker().Submit(func() error { <-block; return nil }) {
+		t.Fatalf("setup: expected the queue's one slot to accept this job")
+	}
+
+	err := hook.Fire(&logrus.Entry{Message: "overflow", Level: logrus.ErrorLevel, Data: logrus.Fields{}})
+	if err == nil {
+		t.Fatalf("expected Fire to report the dropped message, got nil error")
+	}
+}
@@ -0,0 +1,291 @@
+package logrus_mail
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Philoinc/logrus"
+)
+
+// OverflowPolicy controls what a hook does with an entry that arrives once
+// RateLimit's bucket is exhausted.
+type OverflowPolicy int
+
+const (
+	// Drop discards the entry. This is the default.
+	Drop OverflowPolicy = iota
+	// Block waits for a token to become available before sending.
+	Block
+	// SummarizeOnFlush folds the entry into the next admitted send (or
+	// batch flush) as an extra digest line instead of dropping it.
+	SummarizeOnFlush
+)
+
+// RateLimit is a token-bucket limiter: Rate tokens are added per minute, up
+// to a maximum of Burst, and each mail consumes one token. A nil *RateLimit
+// (the default) never limits.
+type RateLimit struct {
+	Rate  int
+	Burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (r *RateLimit) allow() bool {
+	if r == nil || r.Rate <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.last.IsZero() {
+		r.tokens = float64(r.Burst)
+	} else if elapsed := now.Sub(r.last).Minutes(); elapsed > 0 {
+		r.tokens += elapsed * float64(r.Rate)
+		if r.tokens > float64(r.Burst) {
+			r.tokens = float64(r.Burst)
+		}
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Dedup suppresses repeated entries (same level, message, and top stack
+// frame) seen within Window, folding them into a single "repeated N times"
+// summary emitted once the window closes. A nil *Dedup (the default)
+// disables deduplication.
+type Dedup struct {
+	Window time.Duration
+}
+
+// traced pairs a log entry with the stack trace captured for it at Fire
+// time, so that trace stays tied to its entry through dedup and batching,
+// which may deliver it long after the originating call returned.
+type traced struct {
+	entry       *logrus.Entry
+	trace       string
+	goroutineID int
+}
+
+type dedupState struct {
+	item    traced
+	count   int
+	timer   *time.Timer
+	handled bool
+}
+
+// floodConfig is the flood-control knobs a hook exposes, gathered for
+// passing down to floodControlState.
+type floodConfig struct {
+	RateLimit      *RateLimit
+	Dedup          *Dedup
+	BatchInterval  time.Duration
+	OverflowPolicy OverflowPolicy
+}
+
+// floodControlState holds the mutable bookkeeping behind a hook's
+// RateLimit, Dedup and BatchInterval settings. The zero value is ready to
+// use.
+type floodControlState struct {
+	mu sync.Mutex
+
+	dedup      map[string]*dedupState
+	overflowed []traced
+	batch      []traced
+	flushTimer *time.Timer
+}
+
+// Fire routes item through dedup, rate limiting and batching per cfg,
+// calling send with one or more admitted items once they're ready to go
+// out. send may be invoked synchronously (cfg all zero-value) or later,
+// from a timer goroutine (Dedup/BatchInterval configured).
+func (fc *floodControlState) Fire(item traced, cfg floodConfig, send func([]traced)) {
+	if cfg.Dedup != nil && cfg.Dedup.Window > 0 {
+		key := dedupKeyFor(item)
+
+		fc.mu.Lock()
+		if fc.dedup == nil {
+			fc.dedup = make(map[string]*dedupState)
+		}
+		if d, ok := fc.dedup[key]; ok {
+			d.count++
+			fc.mu.Unlock()
+			return
+		}
+		d := &dedupState{item: item, count: 1}
+		d.timer = time.AfterFunc(cfg.Dedup.Window, func() {
+			fc.mu.Lock()
+			if d.handled {
+				fc.mu.Unlock()
+				return
+			}
+			d.handled = true
+			delete(fc.dedup, key)
+			count := d.count
+			fc.mu.Unlock()
+			fc.admit(repeatSummary(d.item, count), cfg, send)
+		})
+		fc.dedup[key] = d
+		fc.mu.Unlock()
+		return
+	}
+
+	fc.admit(item, cfg, send)
+}
+
+func (fc *floodControlState) admit(item traced, cfg floodConfig, send func([]traced)) {
+	if !cfg.RateLimit.allow() {
+		switch cfg.OverflowPolicy {
+		case Block:
+			for !cfg.RateLimit.allow() {
+				time.Sleep(10 * time.Millisecond)
+			}
+		case SummarizeOnFlush:
+			fc.mu.Lock()
+			fc.overflowed = append(fc.overflowed, item)
+			fc.mu.Unlock()
+			return
+		default: // Drop
+			return
+		}
+	}
+
+	fc.mu.Lock()
+	items := append(fc.overflowed, item)
+	fc.overflowed = nil
+	fc.mu.Unlock()
+
+	if cfg.BatchInterval > 0 {
+		fc.enqueueBatch(items, cfg.BatchInterval, send)
+		return
+	}
+	send(items)
+}
+
+func (fc *floodControlState) enqueueBatch(items []traced, interval time.Duration, send func([]traced)) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.batch = append(fc.batch, items...)
+	if fc.flushTimer != nil {
+		return
+	}
+	fc.flushTimer = time.AfterFunc(interval, func() {
+		fc.mu.Lock()
+		pending := fc.batch
+		fc.batch = nil
+		fc.flushTimer = nil
+		fc.mu.Unlock()
+		if len(pending) > 0 {
+			send(pending)
+		}
+	})
+}
+
+// Flush forces every entry still held back by a live Dedup or
+// BatchInterval timer out immediately, stopping those timers, and passes
+// them to send as a single batch. It's meant for a hook's Close, where
+// waiting out the normal window would run past the caller's deadline and
+// abandon whatever was pending.
+//
+// Stopping a dedupState's timer isn't enough on its own: Stop returning
+// false means the timer already fired and its callback is merely blocked
+// on fc.mu, so it still runs once Flush releases the lock. d.handled is
+// checked and set under that same lock by both sides -- whichever gets
+// there first wins -- so the callback and Flush can never both send the
+// same deduped digest.
+func (fc *floodControlState) Flush(send func([]traced)) {
+	fc.mu.Lock()
+	var pending []traced
+	for key, d := range fc.dedup {
+		d.timer.Stop()
+		delete(fc.dedup, key)
+		if d.handled {
+			continue
+		}
+		d.handled = true
+		pending = append(pending, repeatSummary(d.item, d.count))
+	}
+	pending = append(pending, fc.overflowed...)
+	fc.overflowed = nil
+	pending = append(pending, fc.batch...)
+	fc.batch = nil
+	if fc.flushTimer != nil {
+		fc.flushTimer.Stop()
+		fc.flushTimer = nil
+	}
+	fc.mu.Unlock()
+
+	if len(pending) > 0 {
+		send(pending)
+	}
+}
+
+// repeatSummary rewrites item's message to note how many times it repeated
+// within a Dedup window. count of 1 means it never repeated, so item is
+// returned unchanged.
+func repeatSummary(item traced, count int) traced {
+	if count <= 1 {
+		return item
+	}
+	e := *item.entry
+	e.Message = fmt.Sprintf("%s (repeated %d times)", item.entry.Message, count)
+	return traced{entry: &e, trace: item.trace, goroutineID: item.goroutineID}
+}
+
+// digest coalesces items into a single synthetic entry and trace, for
+// BatchInterval flushes and SummarizeOnFlush overflow. A single item passes
+// through untouched. The goroutine id returned is that of the first event,
+// since a digest has no single originating goroutine.
+func digest(items []traced) (*logrus.Entry, string, int) {
+	if len(items) == 1 {
+		return items[0].entry, items[0].trace, items[0].goroutineID
+	}
+
+	highest := items[0].entry.Level
+	lines := make([]string, len(items))
+	var trace strings.Builder
+	for i, it := range items {
+		if it.entry.Level < highest {
+			highest = it.entry.Level
+		}
+		lines[i] = fmt.Sprintf("[%s] %s - %s", it.entry.Time.Format(format), it.entry.Level.String(), it.entry.Message)
+		fmt.Fprintf(&trace, "Event %02d: %s - %s\r\n%s\r\n", i, it.entry.Time.Format(format), it.entry.Message, it.trace)
+	}
+
+	return &logrus.Entry{
+		Time:    time.Now(),
+		Level:   highest,
+		Message: fmt.Sprintf("%d log events", len(items)),
+		Data:    logrus.Fields{"events": lines},
+	}, trace.String(), items[0].goroutineID
+}
+
+// dedupKeyFor hashes the level, message and top stack frame of item's
+// entry, so that genuinely distinct errors never collide.
+func dedupKeyFor(item traced) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%d|%s|%s", item.entry.Level, item.entry.Message, topFrame(item.trace))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// topFrame returns just the first frame of trace, which is what identifies
+// "the same error" for deduplication purposes.
+func topFrame(trace string) string {
+	if idx := strings.Index(trace, "Frame 01:"); idx >= 0 {
+		return trace[:idx]
+	}
+	return trace
+}
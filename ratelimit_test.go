@@ -0,0 +1,150 @@
+package logrus_mail
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Philoinc/logrus"
+)
+
+func tracedEntry(msg string) traced {
+	return traced{entry: &logrus.Entry{Message: msg, Level: logrus.ErrorLevel, Data: logrus.Fields{}}, trace: "Frame 01: somefunc\r\n"}
+}
+
+// TestDedupThenFlush guards against floodControlState.Flush racing the
+// dedup timer it's trying to preempt: Stop returning false just means the
+// timer's callback is blocked on fc.mu, not that it won't run, so without
+// a handled flag both sides can send the same digest.
+func TestDedupThenFlush(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		var fc floodControlState
+		var mu sync.Mutex
+		sent := 0
+		record := func([]traced) {
+			mu.Lock()
+			sent++
+			mu.Unlock()
+		}
+
+		cfg := floodConfig{Dedup: &Dedup{Window: time.Millisecond}}
+		fc.Fire(tracedEntry("boom"), cfg, record)
+		time.Sleep(2 * time.Millisecond) // let the dedup timer fire, so its callback races the Flush below
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fc.Flush(record)
+		}()
+		wg.Wait()
+		// The dedup timer's own goroutine isn't joined by wg -- give it a
+		// moment to finish so a late send (were the bug still present)
+		// has time to show up before we check.
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		got := sent
+		mu.Unlock()
+		if got != 1 {
+			t.Fatalf("iteration %d: digest sent %d times, want exactly 1", i, got)
+		}
+	}
+}
+
+// TestDedupSuppressesRepeats checks the non-race path: repeated entries
+// within the window collapse into one digest noting the repeat count.
+func TestDedupSuppressesRepeats(t *testing.T) {
+	var fc floodControlState
+	var got []traced
+	var mu sync.Mutex
+
+	cfg := floodConfig{Dedup: &Dedup{Window: 20 * time.Millisecond}}
+	for i := 0; i < 5; i++ {
+		fc.Fire(tracedEntry("boom"), cfg, func(items []traced) {
+			mu.Lock()
+			got = append(got, items...)
+			mu.Unlock()
+		})
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("expected exactly one digest, got %d", len(got))
+	}
+	if !strings.Contains(got[0].entry.Message, "repeated 5 times") {
+		t.Fatalf("expected repeat count in message, got %q", got[0].entry.Message)
+	}
+}
+
+// TestOverflowThenFlush checks that an entry held back by
+// SummarizeOnFlush overflow (RateLimit exhausted) is handed to send once
+// Flush runs, the same way Close needs it to be.
+func TestOverflowThenFlush(t *testing.T) {
+	var fc floodControlState
+	var got []traced
+	record := func(items []traced) { got = append(got, items...) }
+
+	cfg := floodConfig{
+		RateLimit:      &RateLimit{Rate: 1, Burst: 0},
+		OverflowPolicy: SummarizeOnFlush,
+	}
+	fc.Fire(tracedEntry("overflowed"), cfg, record)
+
+	if len(got) != 0 {
+		t.Fatalf("expected the overflowed entry to be held back, got %d items sent", len(got))
+	}
+
+	fc.Flush(record)
+
+	if len(got) != 1 {
+		t.Fatalf("expected Flush to deliver the overflowed entry, got %d items", len(got))
+	}
+}
+
+// TestConcurrentFireAndFlush exercises Fire (dedup + batch configured, the
+// combination a hook actually uses) racing Flush under -race, the pattern a
+// Fire landing right as Close runs would hit in production.
+func TestConcurrentFireAndFlush(t *testing.T) {
+	var fc floodControlState
+	var mu sync.Mutex
+	var sentCount int
+	record := func(items []traced) {
+		mu.Lock()
+		sentCount += len(items)
+		mu.Unlock()
+	}
+
+	cfg := floodConfig{
+		Dedup:         &Dedup{Window: time.Millisecond},
+		BatchInterval: time.Millisecond,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fc.Fire(tracedEntry("concurrent"), cfg, record)
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fc.Flush(record)
+	}()
+	wg.Wait()
+
+	// A final Flush mops up anything still pending after the race above.
+	fc.Flush(record)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sentCount == 0 {
+		t.Fatalf("expected at least one item to have been sent or flushed")
+	}
+}
@@ -0,0 +1,72 @@
+package logrus_mail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/smtp"
+)
+
+// TLSMode selects how a hook secures its connection to the SMTP server.
+type TLSMode int
+
+const (
+	// TLSNone sends everything, including credentials and log contents, in
+	// cleartext. This is the default and matches the hooks' historical
+	// behavior.
+	TLSNone TLSMode = iota
+	// TLSStartTLS dials in plaintext and upgrades the connection with
+	// STARTTLS once the server advertises support for it.
+	TLSStartTLS
+	// TLSImplicit dials straight into TLS (as used on port 465) before any
+	// SMTP conversation happens.
+	TLSImplicit
+)
+
+// tlsConfigFor returns conf with ServerName defaulted to host, so callers
+// don't have to repeat the host they already passed to the constructor.
+func tlsConfigFor(conf *tls.Config, host string) *tls.Config {
+	if conf == nil {
+		return &tls.Config{ServerName: host}
+	}
+	if conf.ServerName != "" {
+		return conf
+	}
+	clone := conf.Clone()
+	clone.ServerName = host
+	return clone
+}
+
+// dialSMTP connects to addr according to mode, performing the STARTTLS or
+// implicit-TLS handshake as needed. tlsRequired causes TLSStartTLS to fail
+// instead of silently falling back to plaintext when the server doesn't
+// advertise STARTTLS.
+func dialSMTP(host, addr string, mode TLSMode, tlsConfig *tls.Config, tlsRequired bool) (*smtp.Client, error) {
+	if mode == TLSImplicit {
+		conn, err := tls.Dial("tcp", addr, tlsConfigFor(tlsConfig, host))
+		if err != nil {
+			return nil, err
+		}
+		return smtp.NewClient(conn, host)
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			if tlsRequired {
+				c.Close()
+				return nil, fmt.Errorf("logrus_mail: server %s does not support STARTTLS", host)
+			}
+			return c, nil
+		}
+		if err := c.StartTLS(tlsConfigFor(tlsConfig, host)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,86 @@
+package logrus_mail
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// internalFramePatterns matches stack frames that belong to this package,
+// to logrus itself, or to the Go runtime -- noise that would otherwise top
+// every email with the hook's own call stack instead of the caller's.
+var internalFramePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^logrus_mail\.`),
+	regexp.MustCompile(`^github\.com/Philoinc/logrus\.`),
+	regexp.MustCompile(`^runtime\.`),
+}
+
+// buildTrace assembles a human-readable stack trace for the caller of
+// whatever Fire is handling, using runtime.CallersFrames so inlined
+// functions are expanded correctly. Frames belonging to logrus_mail,
+// logrus, or the runtime are skipped, as are any matching skip.
+// maxFrames caps how many (post-filtering) frames are kept; 0 means
+// MaxFrames.
+func buildTrace(maxFrames int, skip []*regexp.Regexp) string {
+	if maxFrames <= 0 {
+		maxFrames = MaxFrames
+	}
+
+	callers := make([]uintptr, maxFrames+len(internalFramePatterns)+8)
+	depth := runtime.Callers(3, callers)
+	frames := runtime.CallersFrames(callers[:depth])
+
+	var trace bytes.Buffer
+	i := 0
+	for {
+		frame, more := frames.Next()
+		if !skipFrame(frame.Function, skip) {
+			fmt.Fprintf(&trace, "Frame %02d:\r\n", i)
+			fmt.Fprintf(&trace, "\tFile: %s\r\n", frame.File)
+			fmt.Fprintf(&trace, "\tFunction: %s\r\n", frame.Function)
+			fmt.Fprintf(&trace, "\tLine: %d\r\n", frame.Line)
+			i++
+			if i >= maxFrames {
+				break
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return trace.String()
+}
+
+func skipFrame(function string, skip []*regexp.Regexp) bool {
+	for _, re := range internalFramePatterns {
+		if re.MatchString(function) {
+			return true
+		}
+	}
+	for _, re := range skip {
+		if re.MatchString(function) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentGoroutineID extracts the calling goroutine's id from the header
+// runtime.Stack prints ("goroutine 123 [running]: ..."), returning 0 if it
+// can't be parsed.
+func currentGoroutineID() int {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) < 2 {
+		return 0
+	}
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+	return id
+}
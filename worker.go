@@ -0,0 +1,156 @@
+package logrus_mail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDeliveryAttempts bounds how many times deliveryWorker tries a send,
+// the first try included, before giving up on a transient failure.
+const maxDeliveryAttempts = 5
+
+// deliveryWork is a single outbound mail, retried on transient failure.
+type deliveryWork struct {
+	send func() error
+}
+
+// deliveryWorker is a bounded queue of pending mail drained by a small
+// worker pool, shared by MailHook and MailAuthHook so that neither blocks
+// its caller's goroutine on SMTP I/O. The zero value is not usable; build
+// one with newDeliveryWorker.
+type deliveryWorker struct {
+	queue chan deliveryWork
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+
+	sent    int64
+	dropped int64
+	retried int64
+}
+
+// newDeliveryWorker starts workers goroutines draining a queue bounded to
+// queueSize pending mails.
+func newDeliveryWorker(workers, queueSize int) *deliveryWorker {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	w := &deliveryWorker{
+		queue: make(chan deliveryWork, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+	return w
+}
+
+func (w *deliveryWorker) run() {
+	defer w.wg.Done()
+	for work := range w.queue {
+		w.attempt(work)
+	}
+}
+
+func (w *deliveryWorker) attempt(work deliveryWork) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := work.send()
+		if err == nil {
+			atomic.AddInt64(&w.sent, 1)
+			return
+		}
+		if attempt >= maxDeliveryAttempts || !isTransient(err) {
+			atomic.AddInt64(&w.dropped, 1)
+			return
+		}
+		atomic.AddInt64(&w.retried, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether err looks like a temporary SMTP or network
+// failure worth retrying: a 4xx SMTP reply, or a net.Error flagged
+// Temporary or Timeout.
+func isTransient(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Temporary() || netErr.Timeout()
+	}
+	return false
+}
+
+// Submit enqueues send for delivery, returning false (and dropping it)
+// if the worker is closed or its queue is full. mu is held across the
+// queue send so that it can never race with Close closing that same
+// queue -- without it, a Submit that checked "not closed" could still
+// send on a channel Close had just closed, panicking.
+func (w *deliveryWorker) Submit(send func() error) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		atomic.AddInt64(&w.dropped, 1)
+		return false
+	}
+
+	select {
+	case w.queue <- deliveryWork{send: send}:
+		return true
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		return false
+	}
+}
+
+// Close stops accepting new work and waits for whatever is already queued
+// to finish sending, or for ctx to be done, whichever comes first.
+func (w *deliveryWorker) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sent, Dropped and Retried return running totals of messages sent
+// successfully, dropped (queue full, or retries exhausted), and retried
+// after a transient failure. deliveryWorker is unexported and the hooks
+// keep theirs in an unexported field, so these totals are not reachable
+// from outside this package.
+func (w *deliveryWorker) Sent() int64    { return atomic.LoadInt64(&w.sent) }
+func (w *deliveryWorker) Dropped() int64 { return atomic.LoadInt64(&w.dropped) }
+func (w *deliveryWorker) Retried() int64 { return atomic.LoadInt64(&w.retried) }
+
+// QueueDepth returns how many messages are currently queued awaiting a
+// worker.
+func (w *deliveryWorker) QueueDepth() int { return len(w.queue) }
@@ -0,0 +1,32 @@
+package logrus_mail
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSubmitCloseRace guards against a Submit that races Close: Submit must
+// never send on a queue that Close has just closed out from under it. Run
+// with -race; without the mutex guarding both, this panics with "send on
+// closed channel" on close to every run.
+func TestSubmitCloseRace(t *testing.T) {
+	for i := 0; i < 2000; i++ {
+		w := newDeliveryWorker(2, 4)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w.Submit(func() error { return nil })
+		}()
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			w.Close(ctx)
+		}()
+		wg.Wait()
+	}
+}